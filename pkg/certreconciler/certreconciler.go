@@ -0,0 +1,67 @@
+/*
+Copyright 2023 The Tekton Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package certreconciler holds the cert-bundle, owner-reference and
+// namespace-selector plumbing shared by the mutating and validating
+// admission controllers, so the two don't each reimplement it.
+package certreconciler
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"knative.dev/pkg/system"
+	"knative.dev/pkg/webhook"
+	certresources "knative.dev/pkg/webhook/certificates/resources"
+)
+
+// CACertFromSecret fetches the CA cert bundle that the webhook's TLS secret
+// is rotated into, keyed by secretName in the system namespace.
+func CACertFromSecret(secretlister corelisters.SecretLister, secretName string) ([]byte, error) {
+	secret, err := secretlister.Secrets(system.Namespace()).Get(secretName)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching secret: %w", err)
+	}
+	caCert, ok := secret.Data[certresources.CACert]
+	if !ok {
+		return nil, fmt.Errorf("secret %q is missing %q key", secretName, certresources.CACert)
+	}
+	return caCert, nil
+}
+
+// OwnerReferenceForSystemNamespace returns an owner reference pointing at
+// the system namespace, so the webhook configuration is garbage collected
+// along with the rest of the install.
+func OwnerReferenceForSystemNamespace(ctx context.Context, client kubernetes.Interface) (metav1.OwnerReference, error) {
+	ns, err := client.CoreV1().Namespaces().Get(ctx, system.Namespace(), metav1.GetOptions{})
+	if err != nil {
+		return metav1.OwnerReference{}, fmt.Errorf("failed to fetch namespace: %w", err)
+	}
+	return *metav1.NewControllerRef(ns, corev1.SchemeGroupVersion.WithKind("Namespace")), nil
+}
+
+// ExcludeOptOutNamespaces extends sel, preserving any selector terms
+// already present, so that namespaces carrying the
+// "webhooks.knative.dev/exclude" label are skipped by the webhook.
+func ExcludeOptOutNamespaces(sel *metav1.LabelSelector) *metav1.LabelSelector {
+	return webhook.EnsureLabelSelectorExpressions(sel, &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{{
+			Key:      "webhooks.knative.dev/exclude",
+			Operator: metav1.LabelSelectorOpDoesNotExist,
+		}},
+	})
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2023 The Tekton Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mutatingwebhook
+
+import (
+	"strconv"
+
+	"github.com/tektoncd/pipeline/pkg/workspace"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// AffinityTopologyKeyAnnotation overrides the topology key a
+	// PipelineRun's pods are (anti-)affined or spread over. Defaults to
+	// "kubernetes.io/hostname", which co-locates pods on one node.
+	AffinityTopologyKeyAnnotation = "mutatingwebhook.tekton.dev/affinity-topology-key"
+
+	// AffinityModeAnnotation selects "required" (the default) or
+	// "preferred" pod (anti-)affinity.
+	AffinityModeAnnotation = "mutatingwebhook.tekton.dev/affinity-mode"
+
+	// AffinityWeightAnnotation sets the weight, 1-100, used when
+	// AffinityModeAnnotation is "preferred". Defaults to 100.
+	AffinityWeightAnnotation = "mutatingwebhook.tekton.dev/affinity-weight"
+
+	// AntiAffinityAnnotation, set to "true", spreads a PipelineRun's pods
+	// apart across TopologyKey instead of co-locating them.
+	AntiAffinityAnnotation = "mutatingwebhook.tekton.dev/anti-affinity"
+
+	// TopologySpreadAnnotation, set to "true", expresses the policy as a
+	// TopologySpreadConstraint instead of pod (anti-)affinity.
+	TopologySpreadAnnotation = "mutatingwebhook.tekton.dev/topology-spread"
+
+	defaultAffinityTopologyKey = "kubernetes.io/hostname"
+	defaultAffinityWeight      = 100
+)
+
+// affinityPolicy is the per-PipelineRun scheduling policy read from
+// annotations on the pod being admitted.
+type affinityPolicy struct {
+	topologyKey    string
+	preferred      bool
+	weight         int32
+	antiAffinity   bool
+	topologySpread bool
+}
+
+// affinityPolicyFromPod reads an affinityPolicy from pod's annotations,
+// falling back to co-locating required on "kubernetes.io/hostname" -- this
+// module's original, and still default, behavior.
+func affinityPolicyFromPod(pod *corev1.Pod) affinityPolicy {
+	policy := affinityPolicy{
+		topologyKey: defaultAffinityTopologyKey,
+		weight:      defaultAffinityWeight,
+	}
+
+	if v := pod.Annotations[AffinityTopologyKeyAnnotation]; v != "" {
+		policy.topologyKey = v
+	}
+	if pod.Annotations[AffinityModeAnnotation] == "preferred" {
+		policy.preferred = true
+	}
+	if v, ok := pod.Annotations[AffinityWeightAnnotation]; ok {
+		if w, err := strconv.Atoi(v); err == nil && w > 0 && w <= 100 {
+			policy.weight = int32(w)
+		}
+	}
+	policy.antiAffinity = pod.Annotations[AntiAffinityAnnotation] == "true"
+	policy.topologySpread = pod.Annotations[TopologySpreadAnnotation] == "true"
+
+	return policy
+}
+
+// buildAffinityTerms returns the full set of affinity terms and topology
+// spread constraints implied by policy for a PipelineRun named prName.
+// mutatePodAffinity merges the Affinity into the pod's existing one via
+// mergeAffinity and appends the constraints to the pod's existing
+// TopologySpreadConstraints. At most one of the two return values is non-nil.
+func buildAffinityTerms(policy affinityPolicy, prName string) (*corev1.Affinity, []corev1.TopologySpreadConstraint) {
+	selector := &metav1.LabelSelector{
+		MatchLabels: map[string]string{
+			workspace.LabelInstance: getPodAffinityValue(prName),
+		},
+	}
+
+	if policy.topologySpread {
+		return nil, []corev1.TopologySpreadConstraint{{
+			MaxSkew:           1,
+			TopologyKey:       policy.topologyKey,
+			WhenUnsatisfiable: corev1.ScheduleAnyway,
+			LabelSelector:     selector,
+		}}
+	}
+
+	term := corev1.PodAffinityTerm{LabelSelector: selector, TopologyKey: policy.topologyKey}
+	affinity := &corev1.Affinity{}
+
+	if policy.antiAffinity {
+		affinity.PodAntiAffinity = &corev1.PodAntiAffinity{}
+		if policy.preferred {
+			affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution =
+				[]corev1.WeightedPodAffinityTerm{{Weight: policy.weight, PodAffinityTerm: term}}
+		} else {
+			affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution = []corev1.PodAffinityTerm{term}
+		}
+		return affinity, nil
+	}
+
+	affinity.PodAffinity = &corev1.PodAffinity{}
+	if policy.preferred {
+		affinity.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution =
+			[]corev1.WeightedPodAffinityTerm{{Weight: policy.weight, PodAffinityTerm: term}}
+	} else {
+		affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution = []corev1.PodAffinityTerm{term}
+	}
+	return affinity, nil
+}
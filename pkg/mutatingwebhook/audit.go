@@ -0,0 +1,48 @@
+/*
+Copyright 2023 The Tekton Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mutatingwebhook
+
+import (
+	"go.uber.org/zap"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// auditEvent is the structured record emitted for every admission
+// decision. It's redacted of anything but identifiers and sizes: no image
+// names, env vars, or other pod content that might carry secrets.
+type auditEvent struct {
+	UID             string   `json:"uid"`
+	Namespace       string   `json:"namespace"`
+	Pod             string   `json:"pod"`
+	PipelineRun     string   `json:"pipelineRun,omitempty"`
+	AppliedMutators []string `json:"appliedMutators,omitempty"`
+	PatchBytes      int      `json:"patchBytes"`
+	Allowed         bool     `json:"allowed"`
+}
+
+// logAdmissionAudit emits a structured audit event for an admission
+// decision at Info level.
+func logAdmissionAudit(logger *zap.SugaredLogger, request *admissionv1.AdmissionRequest, pod *corev1.Pod, appliedMutators []string, patch []byte, allowed bool) {
+	event := auditEvent{
+		UID:             string(request.UID),
+		Namespace:       pod.Namespace,
+		Pod:             pod.Name,
+		PipelineRun:     pod.Labels["tekton.dev/pipelineRun"],
+		AppliedMutators: appliedMutators,
+		PatchBytes:      len(patch),
+		Allowed:         allowed,
+	}
+	logger.Infow("admission decision", "audit", event)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2023 The Tekton Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mutatingwebhook
+
+import (
+	"context"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	nsinformer "knative.dev/pkg/client/injection/kube/informers/core/v1/namespace"
+)
+
+// DefaultPodMutators returns the mutators this module ships out of the box,
+// in the order they're applied. It reads the namespace informer off ctx the
+// same way NewAdmissionController reads its own informers, so the
+// namespace-level ImageResolutionAnnotation fallback is served from the
+// informer cache instead of a live API call on every admission request.
+func DefaultPodMutators(ctx context.Context, client kubernetes.Interface) []PodMutator {
+	return []PodMutator{
+		&affinityAssistantMutator{},
+		&imageDigestMutator{nsLister: nsinformer.Get(ctx).Lister(), resolver: newDigestResolver(client)},
+		&testLabelMutator{},
+	}
+}
+
+// affinityAssistantMutator applies a PipelineRun's affinityPolicy to its
+// pods: by default it co-locates them via pod affinity, the module's
+// original purpose, and annotations can switch it to anti-affinity or a
+// topology spread constraint.
+type affinityAssistantMutator struct{}
+
+var _ PodMutator = (*affinityAssistantMutator)(nil)
+
+func (*affinityAssistantMutator) Name() string { return "affinity-assistant" }
+
+func (*affinityAssistantMutator) Applies(pod *corev1.Pod) bool {
+	_, found := pod.Labels["tekton.dev/pipelineRun"]
+	return found
+}
+
+func (*affinityAssistantMutator) Mutate(ctx context.Context, pod *corev1.Pod, _ *admissionv1.AdmissionRequest) error {
+	mutatePodAffinity(ctx, pod, pod.Labels["tekton.dev/pipelineRun"])
+	return nil
+}
+
+// imageDigestMutator rewrites tag references to digest references on pods
+// that opt in via ImageResolutionAnnotation.
+type imageDigestMutator struct {
+	nsLister corelisters.NamespaceLister
+	resolver *digestResolver
+}
+
+var _ PodMutator = (*imageDigestMutator)(nil)
+
+func (*imageDigestMutator) Name() string { return "image-digest-resolver" }
+
+// Applies short-circuits on the pod-level annotation before ever looking at
+// the namespace, and falls back to the namespace's annotation only from
+// the (informer-backed) lister -- never a live API-server call -- so an
+// opt-in feature doesn't become a per-pod round trip for every pod admitted
+// by this cluster-wide webhook.
+func (m *imageDigestMutator) Applies(pod *corev1.Pod) bool {
+	if v, ok := pod.Annotations[ImageResolutionAnnotation]; ok {
+		return v == "true"
+	}
+	ns, err := m.nsLister.Get(pod.Namespace)
+	if err != nil {
+		return false
+	}
+	return ns.Annotations[ImageResolutionAnnotation] == "true"
+}
+
+func (m *imageDigestMutator) Mutate(ctx context.Context, pod *corev1.Pod, _ *admissionv1.AdmissionRequest) error {
+	mutateImageDigests(ctx, m.resolver, pod, serviceAccountName(pod))
+	return nil
+}
+
+// testLabelMutator stamps every pod with a fixed label. It's a smoke test
+// that the mutation pipeline is wired up end to end.
+type testLabelMutator struct{}
+
+var _ PodMutator = (*testLabelMutator)(nil)
+
+func (*testLabelMutator) Name() string { return "quan-test-label" }
+
+func (*testLabelMutator) Applies(*corev1.Pod) bool { return true }
+
+func (*testLabelMutator) Mutate(_ context.Context, pod *corev1.Pod, _ *admissionv1.AdmissionRequest) error {
+	if pod.Labels == nil {
+		pod.Labels = make(map[string]string)
+	}
+	pod.Labels["QuanTest"] = "hello1"
+	return nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2023 The Tekton Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mutatingwebhook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn/k8schain"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	lru "github.com/hashicorp/golang-lru/v2/expirable"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// ImageResolutionAnnotation opts a pod, or its namespace, into rewriting
+	// tag-based container images to immutable digest references. Pod-level
+	// annotations take precedence over the namespace default.
+	ImageResolutionAnnotation = "mutatingwebhook.tekton.dev/resolve-digests"
+
+	digestCacheSize = 4096
+	digestCacheTTL  = 10 * time.Minute
+)
+
+// digestResolver rewrites tag references to digest references, consulting
+// the registry with credentials scoped to the pod that's being admitted and
+// caching the result so that pods sharing an image don't each pay for a
+// registry round trip.
+type digestResolver struct {
+	client kubernetes.Interface
+	cache  *lru.LRU[string, string]
+}
+
+func newDigestResolver(client kubernetes.Interface) *digestResolver {
+	return &digestResolver{
+		client: client,
+		cache:  lru.NewLRU[string, string](digestCacheSize, nil, digestCacheTTL),
+	}
+}
+
+// resolve returns the digest reference for image and true, or ("", false)
+// if it couldn't be resolved. Resolution failures are never fatal to the
+// caller: callers fall back to leaving the original image reference alone.
+func (r *digestResolver) resolve(ctx context.Context, namespace, image, serviceAccountName string, pullSecrets []corev1.LocalObjectReference) (string, bool) {
+	logger := logging.FromContext(ctx)
+
+	// The cache is keyed by the credential scope a registry lookup actually
+	// used -- namespace, service account, and pull secret names -- not just
+	// the image tag. Two namespaces asking for the same tag don't
+	// necessarily have the same registry credentials, so they must not be
+	// able to read each other's resolved digest out of a shared cache entry.
+	cacheKey := digestCacheKey(namespace, serviceAccountName, pullSecrets, image)
+
+	if digest, ok := r.cache.Get(cacheKey); ok {
+		return digest, true
+	}
+
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		logger.Warnw("skipping image digest resolution, unparsable reference", "image", image, "error", err)
+		return "", false
+	}
+	if _, ok := ref.(name.Digest); ok {
+		// Already pinned to a digest, nothing to do.
+		return image, true
+	}
+
+	kc, err := k8schain.New(ctx, r.client, k8schain.Options{
+		Namespace:          namespace,
+		ServiceAccountName: serviceAccountName,
+		ImagePullSecrets:   secretNames(pullSecrets),
+	})
+	if err != nil {
+		logger.Warnw("skipping image digest resolution, failed to build keychain", "image", image, "error", err)
+		return "", false
+	}
+
+	desc, err := remote.Get(ref, remote.WithAuthFromKeychain(kc), remote.WithContext(ctx))
+	if err != nil {
+		logger.Warnw("skipping image digest resolution, registry lookup failed", "image", image, "error", err)
+		return "", false
+	}
+
+	digestRef := fmt.Sprintf("%s@%s", ref.Context().Name(), desc.Digest.String())
+	r.cache.Add(cacheKey, digestRef)
+	return digestRef, true
+}
+
+func secretNames(refs []corev1.LocalObjectReference) []string {
+	names := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		names = append(names, ref.Name)
+	}
+	return names
+}
+
+// digestCacheKey scopes a cache entry to the exact credentials a registry
+// lookup would use, so a digest resolved with one namespace's (or service
+// account's) pull secrets is never served to a pod that hasn't had its own
+// credentials checked.
+func digestCacheKey(namespace, serviceAccountName string, pullSecrets []corev1.LocalObjectReference, image string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", namespace, serviceAccountName, strings.Join(secretNames(pullSecrets), ","), image)
+}
+
+// mutateImageDigests rewrites tag-based container and init-container images
+// on p to digest references in place, using serviceAccountName and the
+// pod's ImagePullSecrets for registry auth. Images that can't be resolved
+// are left untouched.
+func mutateImageDigests(ctx context.Context, resolver *digestResolver, p *corev1.Pod, serviceAccountName string) {
+	logger := logging.FromContext(ctx)
+
+	resolveAll := func(containers []corev1.Container) {
+		for i := range containers {
+			digestRef, ok := resolver.resolve(ctx, p.Namespace, containers[i].Image, serviceAccountName, p.Spec.ImagePullSecrets)
+			if !ok {
+				logger.Infof("leaving image %q unresolved", containers[i].Image)
+				continue
+			}
+			containers[i].Image = digestRef
+		}
+	}
+
+	resolveAll(p.Spec.Containers)
+	resolveAll(p.Spec.InitContainers)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2023 The Tekton Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mutatingwebhook
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// The views registered here are exported through knative.dev/pkg/metrics,
+// the same OpenCensus-to-Prometheus exporter sharedmain wires up for every
+// knative controller, so no extra /metrics server needs to be stood up
+// here.
+var (
+	operationKey = tag.MustNewKey("operation")
+	resourceKey  = tag.MustNewKey("resource")
+	mutatedKey   = tag.MustNewKey("mutated")
+	allowedKey   = tag.MustNewKey("allowed")
+
+	admissionRequestsTotalM = stats.Int64(
+		"webhook_admission_requests_total",
+		"Total number of pod admission requests processed",
+		stats.UnitDimensionless)
+
+	admissionLatencySecondsM = stats.Float64(
+		"webhook_admission_latency_seconds",
+		"Latency of pod admission requests",
+		stats.UnitSeconds)
+
+	reconcileErrorsTotalM = stats.Int64(
+		"webhook_reconcile_errors_total",
+		"Total number of MutatingWebhookConfiguration reconcile errors",
+		stats.UnitDimensionless)
+)
+
+func init() {
+	if err := view.Register(
+		&view.View{
+			Name:        "webhook_admission_requests_total",
+			Description: admissionRequestsTotalM.Description(),
+			Measure:     admissionRequestsTotalM,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{operationKey, resourceKey, mutatedKey, allowedKey},
+		},
+		&view.View{
+			Name:        "webhook_admission_latency_seconds",
+			Description: admissionLatencySecondsM.Description(),
+			Measure:     admissionLatencySecondsM,
+			Aggregation: view.Distribution(0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10),
+			TagKeys:     []tag.Key{operationKey, resourceKey},
+		},
+		&view.View{
+			Name:        "webhook_reconcile_errors_total",
+			Description: reconcileErrorsTotalM.Description(),
+			Measure:     reconcileErrorsTotalM,
+			Aggregation: view.Count(),
+		},
+	); err != nil {
+		panic(err)
+	}
+}
+
+// recordAdmission reports a completed admission decision against
+// webhook_admission_requests_total and webhook_admission_latency_seconds.
+func recordAdmission(ctx context.Context, operation, resource string, mutated, allowed bool, start time.Time) {
+	ctx, err := tag.New(ctx,
+		tag.Insert(operationKey, operation),
+		tag.Insert(resourceKey, resource),
+		tag.Insert(mutatedKey, strconv.FormatBool(mutated)),
+		tag.Insert(allowedKey, strconv.FormatBool(allowed)),
+	)
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, admissionRequestsTotalM.M(1), admissionLatencySecondsM.M(time.Since(start).Seconds()))
+}
+
+// recordReconcileError reports a failed webhook configuration reconcile
+// against webhook_reconcile_errors_total.
+func recordReconcileError(ctx context.Context) {
+	stats.Record(ctx, reconcileErrorsTotalM.M(1))
+}
@@ -1,15 +1,14 @@
 package mutatingwebhook
 
 import (
-	"bytes"
 	"context"
 	"crypto/sha256"
-	"encoding/json"
 	"fmt"
+	"time"
 
+	"github.com/QuanZhang-William/copybara-test/pkg/certreconciler"
 	"github.com/tektoncd/pipeline/pkg/workspace"
 	"go.uber.org/zap"
-	"gomodules.xyz/jsonpatch/v2"
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
@@ -32,7 +31,6 @@ import (
 	pkgreconciler "knative.dev/pkg/reconciler"
 	"knative.dev/pkg/system"
 	"knative.dev/pkg/webhook"
-	certresources "knative.dev/pkg/webhook/certificates/resources"
 )
 
 const (
@@ -44,11 +42,15 @@ var (
 	codecs = serializer.NewCodecFactory(scheme)
 )
 
-// NewAdmissionController constructs a reconciler
+// NewAdmissionController constructs a reconciler. mutators is the ordered
+// pipeline of edits applied to every admitted pod; pass DefaultPodMutators
+// to get the mutators this module ships out of the box, or compose your own
+// alongside them.
 func NewAdmissionController(
 	ctx context.Context,
 	name, path string,
 	wc func(context.Context) context.Context,
+	mutators []PodMutator,
 ) *controller.Impl {
 
 	client := kubeclient.Get(ctx)
@@ -73,6 +75,7 @@ func NewAdmissionController(
 		client:       client,
 		mwhlister:    mwhInformer.Lister(),
 		secretlister: secretInformer.Lister(),
+		mutators:     mutators,
 	}
 
 	logger := logging.FromContext(ctx)
@@ -109,6 +112,10 @@ type reconciler struct {
 	mwhlister    admissionlisters.MutatingWebhookConfigurationLister
 	secretlister corelisters.SecretLister
 	secretName   string
+
+	// mutators is the ordered pipeline of edits applied to every admitted
+	// pod; see PodMutator.
+	mutators []PodMutator
 }
 
 var _ controller.Reconciler = (*reconciler)(nil)
@@ -124,18 +131,19 @@ func (ac *reconciler) Reconcile(ctx context.Context, key string) error {
 	}
 
 	// Look up the webhook secret, and fetch the CA cert bundle.
-	secret, err := ac.secretlister.Secrets(system.Namespace()).Get(ac.secretName)
+	caCert, err := certreconciler.CACertFromSecret(ac.secretlister, ac.secretName)
 	if err != nil {
 		logger.Errorw("Error fetching secret", zap.Error(err))
+		recordReconcileError(ctx)
 		return err
 	}
-	caCert, ok := secret.Data[certresources.CACert]
-	if !ok {
-		return fmt.Errorf("secret %q is missing %q key", ac.secretName, certresources.CACert)
-	}
 
 	// Reconcile the webhook configuration.
-	return ac.reconcileMutatingWebhook(ctx, caCert)
+	if err := ac.reconcileMutatingWebhook(ctx, caCert); err != nil {
+		recordReconcileError(ctx)
+		return err
+	}
+	return nil
 }
 
 func (ac *reconciler) reconcileMutatingWebhook(ctx context.Context, caCert []byte) error {
@@ -158,11 +166,10 @@ func (ac *reconciler) reconcileMutatingWebhook(ctx context.Context, caCert []byt
 
 	current := configuredWebhook.DeepCopy()
 
-	ns, err := ac.client.CoreV1().Namespaces().Get(ctx, system.Namespace(), metav1.GetOptions{})
+	nsRef, err := certreconciler.OwnerReferenceForSystemNamespace(ctx, ac.client)
 	if err != nil {
-		return fmt.Errorf("failed to fetch namespace: %w", err)
+		return err
 	}
-	nsRef := *metav1.NewControllerRef(ns, corev1.SchemeGroupVersion.WithKind("Namespace"))
 	current.OwnerReferences = []metav1.OwnerReference{nsRef}
 
 	for i, wh := range current.Webhooks {
@@ -172,16 +179,7 @@ func (ac *reconciler) reconcileMutatingWebhook(ctx context.Context, caCert []byt
 
 		cur := &current.Webhooks[i]
 		cur.Rules = rules
-
-		cur.NamespaceSelector = webhook.EnsureLabelSelectorExpressions(
-			cur.NamespaceSelector,
-			&metav1.LabelSelector{
-				MatchExpressions: []metav1.LabelSelectorRequirement{{
-					Key:      "webhooks.knative.dev/exclude",
-					Operator: metav1.LabelSelectorOpDoesNotExist,
-				}},
-			})
-
+		cur.NamespaceSelector = certreconciler.ExcludeOptOutNamespaces(cur.NamespaceSelector)
 		cur.ClientConfig.CABundle = caCert
 		if cur.ClientConfig.Service == nil {
 			return fmt.Errorf("missing service reference for webhook: %s", wh.Name)
@@ -205,43 +203,76 @@ func (ac *reconciler) reconcileMutatingWebhook(ctx context.Context, caCert []byt
 	return nil
 }
 
-// Admit implements AdmissionController
-// here we modify the pod affinity
-func (ac *reconciler) Admit(ctx context.Context, request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+// Admit implements AdmissionController: it runs the pod mutation pipeline,
+// then records a webhook_admission_requests_total/latency metric and a
+// structured audit log entry for the decision, however it turns out.
+func (ac *reconciler) Admit(ctx context.Context, request *admissionv1.AdmissionRequest) (response *admissionv1.AdmissionResponse) {
 	if ac.withContext != nil {
 		ctx = ac.withContext(ctx)
 	}
 
 	logger := logging.FromContext(ctx)
-	logger.Infof("Quan Test, in admission webhook, request is: %v \n", request)
+	logger.Debugf("admitting pod, request: %v", request)
+
+	start := time.Now()
+	var pod corev1.Pod
+	var appliedMutators []string
+	var patch []byte
+	defer func() {
+		// response is only assigned on the explicit return paths below, so a
+		// panic from a misbehaving mutator (mutators are arbitrary
+		// third-party PodMutator implementations run via runMutators) would
+		// otherwise reach this deferred func with response still nil,
+		// turning one panic into a masked nil-dereference panic that drops
+		// the audit trail along with the original failure.
+		if response == nil {
+			return
+		}
+		recordAdmission(ctx, string(request.Operation), request.Resource.Resource, len(patch) > 0, response.Allowed, start)
+		logAdmissionAudit(logger, request, &pod, appliedMutators, patch, response.Allowed)
+	}()
 
 	// convert the admission request to a pod
 	gvkPod := corev1.SchemeGroupVersion.WithKind("Pod")
-	var pod corev1.Pod
-	codecs.UniversalDeserializer().Decode(request.Object.Raw, &gvkPod, &pod)
+	if _, _, err := codecs.UniversalDeserializer().Decode(request.Object.Raw, &gvkPod, &pod); err != nil {
+		response = &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result:  &metav1.Status{Message: fmt.Sprintf("failed to decode pod: %v", err)},
+		}
+		return response
+	}
 	cpPod := pod.DeepCopy()
 
-	// mutate the pod only when it is created by a pipelinerun
-	if pr, found := pod.Labels["tekton.dev/pipelineRun"]; found {
-		mutatePodAffinity(ctx, &pod, pr)
-	}
+	appliedMutators = runMutators(ctx, ac.mutators, &pod, request)
 
-	// try patch a label for testing purpose
-	if pod.Labels == nil {
-		pod.Labels = make(map[string]string)
+	builder, err := diffPod(cpPod, &pod)
+	if err != nil {
+		logger.Errorw("failed to build admission patch", zap.Error(err))
+		response = &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result:  &metav1.Status{Message: fmt.Sprintf("failed to build admission patch: %v", err)},
+		}
+		return response
+	}
+	patch, err = builder.Build()
+	if err != nil {
+		logger.Errorw("failed to serialize admission patch", zap.Error(err))
+		response = &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result:  &metav1.Status{Message: fmt.Sprintf("failed to serialize admission patch: %v", err)},
+		}
+		return response
 	}
-	pod.Labels["QuanTest"] = "hello1"
-
-	jp := generateJsonPatch(cpPod, &pod)
 
-	return &admissionv1.AdmissionResponse{
-		Patch:   jp,
+	response = &admissionv1.AdmissionResponse{
+		Patch:   patch,
 		Allowed: true,
 		PatchType: func() *admissionv1.PatchType {
 			pt := admissionv1.PatchTypeJSONPatch
 			return &pt
 		}(),
 	}
+	return response
 }
 
 // Path implements AdmissionController
@@ -249,28 +280,17 @@ func (ac *reconciler) Path() string {
 	return ac.path
 }
 
-func ptrReinvocationPolicyType(r admissionregistrationv1.ReinvocationPolicyType) *admissionregistrationv1.ReinvocationPolicyType {
-	return &r
-}
-
-func generateJsonPatch(origin, target *corev1.Pod) []byte {
-	targetBytes := new(bytes.Buffer)
-	json.NewEncoder(targetBytes).Encode(target)
-
-	originBytes := new(bytes.Buffer)
-	json.NewEncoder(originBytes).Encode(origin)
-
-	patch, e := jsonpatch.CreatePatch(originBytes.Bytes(), targetBytes.Bytes())
-	if e != nil {
-		fmt.Printf("error: %v", e)
-	}
-
-	bytes, err := json.Marshal(patch)
-	if err != nil {
-		fmt.Printf("error marshalling patch: %v", err)
+// serviceAccountName returns the service account the pod will run as,
+// defaulting to "default" the same way the API server does.
+func serviceAccountName(p *corev1.Pod) string {
+	if p.Spec.ServiceAccountName != "" {
+		return p.Spec.ServiceAccountName
 	}
+	return "default"
+}
 
-	return bytes
+func ptrReinvocationPolicyType(r admissionregistrationv1.ReinvocationPolicyType) *admissionregistrationv1.ReinvocationPolicyType {
+	return &r
 }
 
 func mutatePodAffinity(ctx context.Context, p *corev1.Pod, pipelineRunName string) {
@@ -280,35 +300,48 @@ func mutatePodAffinity(ctx context.Context, p *corev1.Pod, pipelineRunName strin
 		return
 	}
 
-	// for now we assume the original pod has no pod affinity
-	if p.Spec.Affinity == nil {
-		p.Spec.Affinity = &corev1.Affinity{}
+	policy := affinityPolicyFromPod(p)
+	affinity, spreadConstraints := buildAffinityTerms(policy, pipelineRunName)
+	mergeAffinity(p, affinity)
+	if len(spreadConstraints) > 0 {
+		p.Spec.TopologySpreadConstraints = append(p.Spec.TopologySpreadConstraints, spreadConstraints...)
 	}
-
-	podAffinityName := getPodAffinityValue(pipelineRunName)
-	mergeAffinityWithAffinityAssistant(p.Spec.Affinity, podAffinityName)
 }
 
-func mergeAffinityWithAffinityAssistant(affinity *corev1.Affinity, podAffinityName string) {
-
-	podAffinityTerm := podAffinityTermUsingAffinityAssistant(podAffinityName)
-
-	if affinity.PodAffinity == nil {
-		affinity.PodAffinity = &corev1.PodAffinity{}
+// mergeAffinity merges add into pod's existing Affinity instead of
+// assuming it's nil, appending required/preferred pod-(anti-)affinity terms
+// rather than overwriting whatever was already there.
+func mergeAffinity(pod *corev1.Pod, add *corev1.Affinity) {
+	if add == nil {
+		return
+	}
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &corev1.Affinity{}
 	}
+	target := pod.Spec.Affinity
 
-	affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution =
-		append(affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution, *podAffinityTerm)
-}
+	if add.PodAffinity != nil {
+		if target.PodAffinity == nil {
+			target.PodAffinity = &corev1.PodAffinity{}
+		}
+		target.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution = append(
+			target.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution,
+			add.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution...)
+		target.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(
+			target.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution,
+			add.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution...)
+	}
 
-func podAffinityTermUsingAffinityAssistant(affinityAssistantName string) *corev1.PodAffinityTerm {
-	return &corev1.PodAffinityTerm{LabelSelector: &metav1.LabelSelector{
-		MatchLabels: map[string]string{
-			workspace.LabelInstance: affinityAssistantName,
-			//workspace.LabelComponent: workspace.ComponentNameAffinityAssistant,
-		},
-	},
-		TopologyKey: "kubernetes.io/hostname",
+	if add.PodAntiAffinity != nil {
+		if target.PodAntiAffinity == nil {
+			target.PodAntiAffinity = &corev1.PodAntiAffinity{}
+		}
+		target.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution = append(
+			target.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution,
+			add.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution...)
+		target.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(
+			target.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution,
+			add.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution...)
 	}
 }
 
@@ -0,0 +1,284 @@
+/*
+Copyright 2023 The Tekton Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mutatingwebhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// patchOp is a single RFC 6902 JSON Patch operation.
+type patchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// PodPatchBuilder accumulates explicit, typed edits between a pod's
+// original and mutated state, rather than round-tripping both through
+// encoding/json and diffing the result generically. Every op it emits
+// corresponds to a field a PodMutator is known to touch, so the resulting
+// patch stays minimal and the builder can be exercised with plain
+// in-memory pods in a test, with no live cluster required.
+type PodPatchBuilder struct {
+	origin *corev1.Pod
+	ops    []patchOp
+
+	// These track whether this builder has already emitted the op that
+	// creates an empty/nil parent (labels, annotations, volumes, or
+	// podAffinity), since that's a one-time "add" against the live document
+	// being patched: a second "add" against a path that now exists replaces
+	// rather than merges, silently dropping whatever the first add just put
+	// there. origin never changes across calls, so these can't be
+	// recomputed from it the way the ops themselves are.
+	labelsInitialized      bool
+	annotationsInitialized bool
+	volumesInitialized     bool
+	podAffinityInitialized bool
+}
+
+// NewPodPatchBuilder starts a builder that diffs future edits against
+// origin's state.
+func NewPodPatchBuilder(origin *corev1.Pod) *PodPatchBuilder {
+	return &PodPatchBuilder{origin: origin}
+}
+
+// AddLabel records that key=value was added to the pod's labels.
+func (b *PodPatchBuilder) AddLabel(key, value string) {
+	if len(b.origin.Labels) == 0 && !b.labelsInitialized {
+		b.ops = append(b.ops, patchOp{Op: "add", Path: "/metadata/labels", Value: map[string]string{}})
+		b.labelsInitialized = true
+	}
+	b.ops = append(b.ops, patchOp{Op: "add", Path: "/metadata/labels/" + escapeJSONPointerToken(key), Value: value})
+}
+
+// AddAnnotation records that key=value was added to the pod's annotations.
+func (b *PodPatchBuilder) AddAnnotation(key, value string) {
+	if len(b.origin.Annotations) == 0 && !b.annotationsInitialized {
+		b.ops = append(b.ops, patchOp{Op: "add", Path: "/metadata/annotations", Value: map[string]string{}})
+		b.annotationsInitialized = true
+	}
+	b.ops = append(b.ops, patchOp{Op: "add", Path: "/metadata/annotations/" + escapeJSONPointerToken(key), Value: value})
+}
+
+// AddPodAffinityTerm records that term was appended to the pod's required
+// pod-affinity terms.
+func (b *PodPatchBuilder) AddPodAffinityTerm(term corev1.PodAffinityTerm) {
+	switch {
+	case b.podAffinityInitialized:
+		b.ops = append(b.ops, patchOp{Op: "add", Path: "/spec/affinity/podAffinity/requiredDuringSchedulingIgnoredDuringExecution/-", Value: term})
+	case b.origin.Spec.Affinity == nil:
+		b.ops = append(b.ops, patchOp{Op: "add", Path: "/spec/affinity", Value: &corev1.Affinity{
+			PodAffinity: &corev1.PodAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{term},
+			},
+		}})
+		b.podAffinityInitialized = true
+	case b.origin.Spec.Affinity.PodAffinity == nil:
+		b.ops = append(b.ops, patchOp{Op: "add", Path: "/spec/affinity/podAffinity", Value: &corev1.PodAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{term},
+		}})
+		b.podAffinityInitialized = true
+	default:
+		b.ops = append(b.ops, patchOp{Op: "add", Path: "/spec/affinity/podAffinity/requiredDuringSchedulingIgnoredDuringExecution/-", Value: term})
+	}
+}
+
+// SetAffinity records that the pod's whole Affinity was replaced with
+// affinity. It's coarser than AddPodAffinityTerm, but it's the only thing
+// that can express pod anti-affinity and preferred terms without the
+// builder having to special-case every shape of Affinity a policy can
+// produce.
+func (b *PodPatchBuilder) SetAffinity(affinity *corev1.Affinity) {
+	op := "replace"
+	if b.origin.Spec.Affinity == nil {
+		op = "add"
+	}
+	b.ops = append(b.ops, patchOp{Op: op, Path: "/spec/affinity", Value: affinity})
+}
+
+// SetTopologySpreadConstraints records that the pod's
+// TopologySpreadConstraints were replaced with constraints.
+func (b *PodPatchBuilder) SetTopologySpreadConstraints(constraints []corev1.TopologySpreadConstraint) {
+	op := "replace"
+	if len(b.origin.Spec.TopologySpreadConstraints) == 0 {
+		op = "add"
+	}
+	b.ops = append(b.ops, patchOp{Op: op, Path: "/spec/topologySpreadConstraints", Value: constraints})
+}
+
+// SetContainerImage records that the container at idx had its image
+// rewritten.
+func (b *PodPatchBuilder) SetContainerImage(idx int, image string) {
+	b.ops = append(b.ops, patchOp{Op: "replace", Path: fmt.Sprintf("/spec/containers/%d/image", idx), Value: image})
+}
+
+// SetInitContainerImage records that the init container at idx had its
+// image rewritten.
+func (b *PodPatchBuilder) SetInitContainerImage(idx int, image string) {
+	b.ops = append(b.ops, patchOp{Op: "replace", Path: fmt.Sprintf("/spec/initContainers/%d/image", idx), Value: image})
+}
+
+// AddVolume records that volume was appended to the pod's volumes.
+func (b *PodPatchBuilder) AddVolume(volume corev1.Volume) {
+	if len(b.origin.Spec.Volumes) == 0 && !b.volumesInitialized {
+		b.ops = append(b.ops, patchOp{Op: "add", Path: "/spec/volumes", Value: []corev1.Volume{}})
+		b.volumesInitialized = true
+	}
+	b.ops = append(b.ops, patchOp{Op: "add", Path: "/spec/volumes/-", Value: volume})
+}
+
+// Empty reports whether any operations have been recorded.
+func (b *PodPatchBuilder) Empty() bool {
+	return len(b.ops) == 0
+}
+
+// Build serializes the accumulated operations to a JSONPatch document. It
+// returns a nil patch, rather than an error, when nothing was recorded.
+func (b *PodPatchBuilder) Build() ([]byte, error) {
+	if b.Empty() {
+		return nil, nil
+	}
+	patch, err := json.Marshal(b.ops)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling json patch: %w", err)
+	}
+	return patch, nil
+}
+
+// diffPod compares origin and target pods across every field a PodMutator
+// is expected to touch and returns the typed patch describing the
+// difference. It returns an error if a mutator did something the builder
+// can't express as a minimal patch, such as removing a container.
+func diffPod(origin, target *corev1.Pod) (*PodPatchBuilder, error) {
+	b := NewPodPatchBuilder(origin)
+
+	for k, v := range target.Labels {
+		if origin.Labels[k] != v {
+			b.AddLabel(k, v)
+		}
+	}
+	for k, v := range target.Annotations {
+		if origin.Annotations[k] != v {
+			b.AddAnnotation(k, v)
+		}
+	}
+
+	if err := diffAffinity(b, origin, target); err != nil {
+		return nil, err
+	}
+	if !reflect.DeepEqual(origin.Spec.TopologySpreadConstraints, target.Spec.TopologySpreadConstraints) {
+		if len(target.Spec.TopologySpreadConstraints) < len(origin.Spec.TopologySpreadConstraints) {
+			return nil, fmt.Errorf("pod mutators must not remove topology spread constraints")
+		}
+		b.SetTopologySpreadConstraints(target.Spec.TopologySpreadConstraints)
+	}
+
+	if len(target.Spec.Containers) != len(origin.Spec.Containers) {
+		return nil, fmt.Errorf("pod mutators must not add or remove containers: had %d, now %d", len(origin.Spec.Containers), len(target.Spec.Containers))
+	}
+	for i, c := range target.Spec.Containers {
+		if c.Image != origin.Spec.Containers[i].Image {
+			b.SetContainerImage(i, c.Image)
+		}
+	}
+
+	if len(target.Spec.InitContainers) != len(origin.Spec.InitContainers) {
+		return nil, fmt.Errorf("pod mutators must not add or remove init containers: had %d, now %d", len(origin.Spec.InitContainers), len(target.Spec.InitContainers))
+	}
+	for i, c := range target.Spec.InitContainers {
+		if c.Image != origin.Spec.InitContainers[i].Image {
+			b.SetInitContainerImage(i, c.Image)
+		}
+	}
+
+	if len(target.Spec.Volumes) < len(origin.Spec.Volumes) {
+		return nil, fmt.Errorf("pod mutators must not remove volumes")
+	}
+	for _, v := range target.Spec.Volumes[len(origin.Spec.Volumes):] {
+		b.AddVolume(v)
+	}
+
+	return b, nil
+}
+
+// diffAffinity diffs origin and target's Affinity. When origin already has
+// a PodAffinity and the only change is required pod-affinity terms appended
+// to it (the affinity-assistant case on such a pod), the change is
+// expressed as minimal per-term adds. Anything else -- a newly created
+// Affinity or PodAffinity, anti-affinity, preferred terms, or any other
+// shape an affinityPolicy can produce -- falls back to setting the whole
+// Affinity in one op.
+func diffAffinity(b *PodPatchBuilder, origin, target *corev1.Pod) error {
+	if reflect.DeepEqual(origin.Spec.Affinity, target.Spec.Affinity) {
+		return nil
+	}
+
+	originTerms := requiredPodAffinityTerms(origin.Spec.Affinity)
+	targetTerms := requiredPodAffinityTerms(target.Spec.Affinity)
+
+	if onlyAppendedRequiredPodAffinityTerms(origin.Spec.Affinity, target.Spec.Affinity) {
+		if len(targetTerms) < len(originTerms) {
+			return fmt.Errorf("pod mutators must not remove pod affinity terms")
+		}
+		for i := range originTerms {
+			if !reflect.DeepEqual(originTerms[i], targetTerms[i]) {
+				return fmt.Errorf("pod mutators must not modify existing pod affinity terms in place")
+			}
+		}
+		for _, term := range targetTerms[len(originTerms):] {
+			b.AddPodAffinityTerm(term)
+		}
+		return nil
+	}
+
+	b.SetAffinity(target.Spec.Affinity)
+	return nil
+}
+
+func requiredPodAffinityTerms(a *corev1.Affinity) []corev1.PodAffinityTerm {
+	if a == nil || a.PodAffinity == nil {
+		return nil
+	}
+	return a.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+}
+
+// onlyAppendedRequiredPodAffinityTerms reports whether target's Affinity
+// equals origin's once both have their required pod-affinity terms
+// cleared: every other field, preferred terms and pod anti-affinity
+// included, is unchanged. A nil Affinity or PodAffinity on one side and a
+// non-nil one on the other counts as a difference. Whether the required
+// terms were only appended to is checked by the caller.
+func onlyAppendedRequiredPodAffinityTerms(origin, target *corev1.Affinity) bool {
+	clearRequired := func(a *corev1.Affinity) *corev1.Affinity {
+		if a == nil {
+			return nil
+		}
+		cp := a.DeepCopy()
+		if cp.PodAffinity != nil {
+			cp.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution = nil
+		}
+		return cp
+	}
+	return reflect.DeepEqual(clearRequired(origin), clearRequired(target))
+}
+
+func escapeJSONPointerToken(token string) string {
+	token = strings.ReplaceAll(token, "~", "~0")
+	return strings.ReplaceAll(token, "/", "~1")
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2023 The Tekton Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mutatingwebhook
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func basePod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "some-pod",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			Containers:     []corev1.Container{{Name: "main", Image: "repo/img:v1"}},
+			InitContainers: []corev1.Container{{Name: "init", Image: "repo/init:v1"}},
+			Volumes:        []corev1.Volume{{Name: "existing"}},
+		},
+	}
+}
+
+func TestDiffPod_AddsLabelAndAnnotation(t *testing.T) {
+	origin := basePod()
+	target := origin.DeepCopy()
+	target.Labels = map[string]string{"quan": "hello"}
+	target.Annotations = map[string]string{"mutatingwebhook.tekton.dev/foo": "bar"}
+
+	b, err := diffPod(origin, target)
+	if err != nil {
+		t.Fatalf("diffPod() error = %v", err)
+	}
+	if b.Empty() {
+		t.Fatal("diffPod() produced no ops for a label/annotation add")
+	}
+	patch, err := b.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if len(patch) == 0 {
+		t.Fatal("Build() returned an empty patch for a non-empty builder")
+	}
+}
+
+func TestDiffPod_NoChanges(t *testing.T) {
+	origin := basePod()
+	target := origin.DeepCopy()
+
+	b, err := diffPod(origin, target)
+	if err != nil {
+		t.Fatalf("diffPod() error = %v", err)
+	}
+	if !b.Empty() {
+		t.Error("diffPod() produced ops for identical pods")
+	}
+	patch, err := b.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if patch != nil {
+		t.Errorf("Build() = %s, want nil patch for no changes", patch)
+	}
+}
+
+func TestDiffPod_AppendedPodAffinityTermIsMinimalPatch(t *testing.T) {
+	origin := basePod()
+	origin.Spec.Affinity = &corev1.Affinity{
+		PodAffinity: &corev1.PodAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
+				{TopologyKey: "kubernetes.io/hostname"},
+			},
+		},
+	}
+	target := origin.DeepCopy()
+	target.Spec.Affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution = append(
+		target.Spec.Affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution,
+		corev1.PodAffinityTerm{TopologyKey: "topology.kubernetes.io/zone"},
+	)
+
+	b, err := diffPod(origin, target)
+	if err != nil {
+		t.Fatalf("diffPod() error = %v", err)
+	}
+	if len(b.ops) != 1 || b.ops[0].Op != "add" || b.ops[0].Path != "/spec/affinity/podAffinity/requiredDuringSchedulingIgnoredDuringExecution/-" {
+		t.Errorf("diffPod() ops = %+v, want a single append op for the new affinity term", b.ops)
+	}
+}
+
+func TestDiffPod_RicherAffinityChangeFallsBackToFullReplace(t *testing.T) {
+	origin := basePod()
+	target := origin.DeepCopy()
+	target.Spec.Affinity = &corev1.Affinity{
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
+				{TopologyKey: "kubernetes.io/hostname"},
+			},
+		},
+	}
+
+	b, err := diffPod(origin, target)
+	if err != nil {
+		t.Fatalf("diffPod() error = %v", err)
+	}
+	if len(b.ops) != 1 || b.ops[0].Op != "add" || b.ops[0].Path != "/spec/affinity" {
+		t.Errorf("diffPod() ops = %+v, want a single whole-affinity replace op", b.ops)
+	}
+}
+
+func TestDiffPod_ContainerImageChange(t *testing.T) {
+	origin := basePod()
+	target := origin.DeepCopy()
+	target.Spec.Containers[0].Image = "repo/img@sha256:abc"
+
+	b, err := diffPod(origin, target)
+	if err != nil {
+		t.Fatalf("diffPod() error = %v", err)
+	}
+	if len(b.ops) != 1 || b.ops[0].Op != "replace" || b.ops[0].Path != "/spec/containers/0/image" {
+		t.Errorf("diffPod() ops = %+v, want a single container image replace op", b.ops)
+	}
+}
+
+func TestDiffPod_AddsVolume(t *testing.T) {
+	origin := basePod()
+	target := origin.DeepCopy()
+	target.Spec.Volumes = append(target.Spec.Volumes, corev1.Volume{Name: "new"})
+
+	b, err := diffPod(origin, target)
+	if err != nil {
+		t.Fatalf("diffPod() error = %v", err)
+	}
+	if len(b.ops) != 1 || b.ops[0].Op != "add" || b.ops[0].Path != "/spec/volumes/-" {
+		t.Errorf("diffPod() ops = %+v, want a single volume append op", b.ops)
+	}
+}
+
+func TestDiffPod_RejectsContainerRemoval(t *testing.T) {
+	origin := basePod()
+	target := origin.DeepCopy()
+	target.Spec.Containers = nil
+
+	if _, err := diffPod(origin, target); err == nil {
+		t.Error("diffPod() = nil error, want an error when a container is removed")
+	}
+}
+
+func TestDiffPod_RejectsInitContainerRemoval(t *testing.T) {
+	origin := basePod()
+	target := origin.DeepCopy()
+	target.Spec.InitContainers = nil
+
+	if _, err := diffPod(origin, target); err == nil {
+		t.Error("diffPod() = nil error, want an error when an init container is removed")
+	}
+}
+
+func TestDiffPod_RejectsVolumeRemoval(t *testing.T) {
+	origin := basePod()
+	target := origin.DeepCopy()
+	target.Spec.Volumes = nil
+
+	if _, err := diffPod(origin, target); err == nil {
+		t.Error("diffPod() = nil error, want an error when a volume is removed")
+	}
+}
+
+func countOpsAtPath(ops []patchOp, path string) int {
+	n := 0
+	for _, op := range ops {
+		if op.Path == path {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPodPatchBuilder_TwoLabelsFromEmptyBaseInitializeParentOnce(t *testing.T) {
+	origin := basePod()
+	b := NewPodPatchBuilder(origin)
+	b.AddLabel("a", "1")
+	b.AddLabel("b", "2")
+
+	if n := countOpsAtPath(b.ops, "/metadata/labels"); n != 1 {
+		t.Errorf("got %d ops creating /metadata/labels, want exactly 1 -- a second create would wipe out the first label", n)
+	}
+	if countOpsAtPath(b.ops, "/metadata/labels/a") != 1 || countOpsAtPath(b.ops, "/metadata/labels/b") != 1 {
+		t.Errorf("ops = %+v, want one add per label", b.ops)
+	}
+}
+
+func TestPodPatchBuilder_TwoAnnotationsFromEmptyBaseInitializeParentOnce(t *testing.T) {
+	origin := basePod()
+	b := NewPodPatchBuilder(origin)
+	b.AddAnnotation("a", "1")
+	b.AddAnnotation("b", "2")
+
+	if n := countOpsAtPath(b.ops, "/metadata/annotations"); n != 1 {
+		t.Errorf("got %d ops creating /metadata/annotations, want exactly 1 -- a second create would wipe out the first annotation", n)
+	}
+}
+
+func TestPodPatchBuilder_TwoVolumesFromEmptyBaseInitializeParentOnce(t *testing.T) {
+	origin := basePod()
+	origin.Spec.Volumes = nil
+	b := NewPodPatchBuilder(origin)
+	b.AddVolume(corev1.Volume{Name: "a"})
+	b.AddVolume(corev1.Volume{Name: "b"})
+
+	if n := countOpsAtPath(b.ops, "/spec/volumes"); n != 1 {
+		t.Errorf("got %d ops creating /spec/volumes, want exactly 1 -- a second create would wipe out the first volume", n)
+	}
+	if n := countOpsAtPath(b.ops, "/spec/volumes/-"); n != 2 {
+		t.Errorf("got %d append ops, want 2", n)
+	}
+}
+
+func TestPodPatchBuilder_TwoPodAffinityTermsFromNilAffinityInitializeParentOnce(t *testing.T) {
+	origin := basePod()
+	b := NewPodPatchBuilder(origin)
+	b.AddPodAffinityTerm(corev1.PodAffinityTerm{TopologyKey: "kubernetes.io/hostname"})
+	b.AddPodAffinityTerm(corev1.PodAffinityTerm{TopologyKey: "topology.kubernetes.io/zone"})
+
+	if n := countOpsAtPath(b.ops, "/spec/affinity"); n != 1 {
+		t.Errorf("got %d ops creating /spec/affinity, want exactly 1 -- a second create would wipe out the first term", n)
+	}
+	if n := countOpsAtPath(b.ops, "/spec/affinity/podAffinity/requiredDuringSchedulingIgnoredDuringExecution/-"); n != 1 {
+		t.Errorf("got %d append ops for the second term, want 1", n)
+	}
+}
+
+func TestDiffPod_RejectsPodAffinityTermRemoval(t *testing.T) {
+	origin := basePod()
+	origin.Spec.Affinity = &corev1.Affinity{
+		PodAffinity: &corev1.PodAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
+				{TopologyKey: "kubernetes.io/hostname"},
+				{TopologyKey: "topology.kubernetes.io/zone"},
+			},
+		},
+	}
+	target := origin.DeepCopy()
+	target.Spec.Affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution =
+		target.Spec.Affinity.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution[:1]
+
+	if _, err := diffPod(origin, target); err == nil {
+		t.Error("diffPod() = nil error, want an error when a required pod affinity term is removed")
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2023 The Tekton Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mutatingwebhook
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/pkg/logging"
+)
+
+// PodMutator is a single, independently pluggable edit applied to an
+// admitted pod. The reconciler runs every mutator whose Applies predicate
+// matches and composes their edits into one JSONPatch. Built-in mutators
+// ship in builtin_mutators.go; downstream users supply their own to
+// NewAdmissionController without forking this package (sidecar injection,
+// resource-limit defaulting, toleration injection, etc).
+type PodMutator interface {
+	// Name identifies the mutator in logs and in the audit event's list of
+	// applied mutators.
+	Name() string
+
+	// Applies reports whether this mutator should run against pod. It must
+	// not mutate pod.
+	Applies(pod *corev1.Pod) bool
+
+	// Mutate edits pod in place. A returned error is logged by the caller;
+	// it does not prevent other mutators in the pipeline from running.
+	Mutate(ctx context.Context, pod *corev1.Pod, req *admissionv1.AdmissionRequest) error
+}
+
+// runMutators applies every mutator whose Applies predicate matches pod, in
+// order, logging individual mutator errors rather than aborting the rest of
+// the pipeline. It returns the names of the mutators that ran successfully,
+// for the audit log.
+func runMutators(ctx context.Context, mutators []PodMutator, pod *corev1.Pod, req *admissionv1.AdmissionRequest) []string {
+	logger := logging.FromContext(ctx)
+	var applied []string
+	for _, m := range mutators {
+		if !m.Applies(pod) {
+			continue
+		}
+		if err := m.Mutate(ctx, pod, req); err != nil {
+			logger.Errorw("pod mutator failed", "mutator", m.Name(), zap.Error(err))
+			continue
+		}
+		applied = append(applied, m.Name())
+	}
+	return applied
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2023 The Tekton Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validatingwebhook
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// ConfigMapName is the ConfigMap this controller watches for its pod
+// policy, in the system namespace.
+const ConfigMapName = "pod-policy-config"
+
+// policyConfigMapKey is the key under which the PodPolicy YAML lives in
+// ConfigMapName's Data.
+const policyConfigMapKey = "policy"
+
+// PodPolicy is the set of rules CREATE/UPDATE pods must satisfy, loaded
+// from ConfigMapName.
+type PodPolicy struct {
+	// RequiredLabels are label keys that must be present on every pod.
+	RequiredLabels []string `json:"requiredLabels,omitempty"`
+
+	// DisallowHostPathVolumes rejects pods that mount a hostPath volume.
+	DisallowHostPathVolumes bool `json:"disallowHostPathVolumes,omitempty"`
+
+	// RequireResourceRequests rejects containers that don't set CPU and
+	// memory requests.
+	RequireResourceRequests bool `json:"requireResourceRequests,omitempty"`
+
+	// AllowedRegistries, if non-empty, rejects any container or init
+	// container image that neither equals one of the listed entries nor
+	// starts with one followed by "/". The match is on the image string as
+	// written: an image with no registry in its name, such as "nginx:1.25",
+	// is not matched by "docker.io".
+	AllowedRegistries []string `json:"allowedRegistries,omitempty"`
+}
+
+// parsePodPolicy decodes a PodPolicy from a ConfigMap's Data.
+func parsePodPolicy(data map[string]string) (*PodPolicy, error) {
+	policy := &PodPolicy{}
+	raw, ok := data[policyConfigMapKey]
+	if !ok {
+		return policy, nil
+	}
+	if err := yaml.Unmarshal([]byte(raw), policy); err != nil {
+		return nil, fmt.Errorf("invalid %q: %w", policyConfigMapKey, err)
+	}
+	return policy, nil
+}
+
+// evaluate checks pod against policy and returns the reasons it's
+// disallowed, if any. An empty slice means pod is allowed.
+func evaluate(policy *PodPolicy, pod *corev1.Pod) []string {
+	var violations []string
+
+	for _, key := range policy.RequiredLabels {
+		if _, ok := pod.Labels[key]; !ok {
+			violations = append(violations, fmt.Sprintf("missing required label %q", key))
+		}
+	}
+
+	if policy.DisallowHostPathVolumes {
+		for _, v := range pod.Spec.Volumes {
+			if v.HostPath != nil {
+				violations = append(violations, fmt.Sprintf("volume %q uses a disallowed hostPath", v.Name))
+			}
+		}
+	}
+
+	allContainers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+
+	if policy.RequireResourceRequests {
+		for _, c := range allContainers {
+			if _, ok := c.Resources.Requests[corev1.ResourceCPU]; !ok {
+				violations = append(violations, fmt.Sprintf("container %q is missing a cpu request", c.Name))
+			}
+			if _, ok := c.Resources.Requests[corev1.ResourceMemory]; !ok {
+				violations = append(violations, fmt.Sprintf("container %q is missing a memory request", c.Name))
+			}
+		}
+	}
+
+	if len(policy.AllowedRegistries) > 0 {
+		for _, c := range allContainers {
+			if !imageFromAllowedRegistry(c.Image, policy.AllowedRegistries) {
+				violations = append(violations, fmt.Sprintf("container %q image %q is not from an allowed registry", c.Name, c.Image))
+			}
+		}
+	}
+
+	return violations
+}
+
+func imageFromAllowedRegistry(image string, allowed []string) bool {
+	for _, registry := range allowed {
+		if strings.HasPrefix(image, registry+"/") || image == registry {
+			return true
+		}
+	}
+	return false
+}
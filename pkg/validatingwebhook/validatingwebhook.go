@@ -0,0 +1,255 @@
+/*
+Copyright 2023 The Tekton Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package validatingwebhook rejects pods that violate a configurable set of
+// policies (see PodPolicy), as a sibling to pkg/mutatingwebhook. The two
+// share their cert-bundle/owner-reference/namespace-selector plumbing via
+// pkg/certreconciler rather than each reimplementing it.
+package validatingwebhook
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/QuanZhang-William/copybara-test/pkg/certreconciler"
+	"go.uber.org/zap"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	vwhlisters "k8s.io/client-go/listers/admissionregistration/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	kubeclient "knative.dev/pkg/client/injection/kube/client"
+	vwhinformer "knative.dev/pkg/client/injection/kube/informers/admissionregistration/v1/validatingwebhookconfiguration"
+	cminformer "knative.dev/pkg/client/injection/kube/informers/core/v1/configmap"
+	"knative.dev/pkg/controller"
+	secretinformer "knative.dev/pkg/injection/clients/namespacedkube/informers/core/v1/secret"
+	"knative.dev/pkg/kmp"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/ptr"
+	pkgreconciler "knative.dev/pkg/reconciler"
+	"knative.dev/pkg/system"
+	"knative.dev/pkg/webhook"
+)
+
+var (
+	scheme = runtime.NewScheme()
+	codecs = serializer.NewCodecFactory(scheme)
+)
+
+// NewValidatingAdmissionController constructs a reconciler for a
+// ValidatingWebhookConfiguration that enforces PodPolicy.
+func NewValidatingAdmissionController(
+	ctx context.Context,
+	name, path string,
+	wc func(context.Context) context.Context,
+) *controller.Impl {
+
+	client := kubeclient.Get(ctx)
+	vwhInformer := vwhinformer.Get(ctx)
+	secretInformer := secretinformer.Get(ctx)
+	cmInformer := cminformer.Get(ctx)
+	options := webhook.GetOptions(ctx)
+
+	key := types.NamespacedName{Name: name}
+
+	ac := &reconciler{
+		LeaderAwareFuncs: pkgreconciler.LeaderAwareFuncs{
+			PromoteFunc: func(bkt pkgreconciler.Bucket, enq func(pkgreconciler.Bucket, types.NamespacedName)) error {
+				enq(bkt, key)
+				return nil
+			},
+		},
+		key:          key,
+		path:         path,
+		withContext:  wc,
+		secretName:   options.SecretName,
+		client:       client,
+		vwhlister:    vwhInformer.Lister(),
+		secretlister: secretInformer.Lister(),
+		cmlister:     cmInformer.Lister(),
+	}
+
+	logger := logging.FromContext(ctx)
+	const queueName = "ValidatingWebhook"
+	c := controller.NewContext(ctx, ac, controller.ControllerOptions{WorkQueueName: queueName, Logger: logger.Named(queueName)})
+
+	vwhInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: controller.FilterWithName(name),
+		Handler:    controller.HandleAll(c.Enqueue),
+	})
+
+	secretInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: controller.FilterWithNameAndNamespace(system.Namespace(), ac.secretName),
+		Handler:    controller.HandleAll(c.Enqueue),
+	})
+
+	cmInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: controller.FilterWithNameAndNamespace(system.Namespace(), ConfigMapName),
+		Handler:    controller.HandleAll(c.Enqueue),
+	})
+
+	return c
+}
+
+// reconciler implements the ValidatingAdmissionController.
+type reconciler struct {
+	webhook.StatelessAdmissionImpl
+	pkgreconciler.LeaderAwareFuncs
+	key          types.NamespacedName
+	path         string
+	withContext  func(context.Context) context.Context
+	client       kubernetes.Interface
+	vwhlister    vwhlisters.ValidatingWebhookConfigurationLister
+	secretlister corelisters.SecretLister
+	cmlister     corelisters.ConfigMapLister
+	secretName   string
+}
+
+var _ controller.Reconciler = (*reconciler)(nil)
+var _ pkgreconciler.LeaderAware = (*reconciler)(nil)
+var _ webhook.AdmissionController = (*reconciler)(nil)
+var _ webhook.StatelessAdmissionController = (*reconciler)(nil)
+
+func (ac *reconciler) Reconcile(ctx context.Context, key string) error {
+	logger := logging.FromContext(ctx)
+
+	if !ac.IsLeaderFor(ac.key) {
+		return controller.NewSkipKey(key)
+	}
+
+	caCert, err := certreconciler.CACertFromSecret(ac.secretlister, ac.secretName)
+	if err != nil {
+		logger.Errorw("Error fetching secret", zap.Error(err))
+		return err
+	}
+
+	return ac.reconcileValidatingWebhook(ctx, caCert)
+}
+
+func (ac *reconciler) reconcileValidatingWebhook(ctx context.Context, caCert []byte) error {
+	logger := logging.FromContext(ctx)
+	rules := []admissionregistrationv1.RuleWithOperations{{
+		Operations: []admissionregistrationv1.OperationType{
+			admissionregistrationv1.Create,
+			admissionregistrationv1.Update,
+		},
+		Rule: admissionregistrationv1.Rule{
+			APIGroups:   []string{""},
+			APIVersions: []string{"v1"},
+			Resources:   []string{"pods"},
+		},
+	}}
+
+	configuredWebhook, err := ac.vwhlister.Get(ac.key.Name)
+	if err != nil {
+		return fmt.Errorf("error retrieving webhook: %w", err)
+	}
+
+	current := configuredWebhook.DeepCopy()
+
+	nsRef, err := certreconciler.OwnerReferenceForSystemNamespace(ctx, ac.client)
+	if err != nil {
+		return err
+	}
+	current.OwnerReferences = []metav1.OwnerReference{nsRef}
+
+	for i, wh := range current.Webhooks {
+		if wh.Name != current.Name {
+			continue
+		}
+
+		cur := &current.Webhooks[i]
+		cur.Rules = rules
+		cur.NamespaceSelector = certreconciler.ExcludeOptOutNamespaces(cur.NamespaceSelector)
+		cur.ClientConfig.CABundle = caCert
+		if cur.ClientConfig.Service == nil {
+			return fmt.Errorf("missing service reference for webhook: %s", wh.Name)
+		}
+		cur.ClientConfig.Service.Path = ptr.String(ac.Path())
+	}
+
+	if ok, err := kmp.SafeEqual(configuredWebhook, current); err != nil {
+		return fmt.Errorf("error diffing webhooks: %w", err)
+	} else if !ok {
+		logger.Info("Updating webhook")
+		vwhclient := ac.client.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+		if _, err := vwhclient.Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("failed to update webhook: %w", err)
+		}
+	} else {
+		logger.Info("Webhook is valid")
+	}
+	return nil
+}
+
+// Admit implements AdmissionController. Despite the name (shared with the
+// mutating webhook's interface), this reconciler never mutates the pod: it
+// only allows or rejects it against the configured PodPolicy.
+func (ac *reconciler) Admit(ctx context.Context, request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if ac.withContext != nil {
+		ctx = ac.withContext(ctx)
+	}
+	logger := logging.FromContext(ctx)
+
+	gvkPod := corev1.SchemeGroupVersion.WithKind("Pod")
+	var pod corev1.Pod
+	if _, _, err := codecs.UniversalDeserializer().Decode(request.Object.Raw, &gvkPod, &pod); err != nil {
+		return &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result:  &metav1.Status{Message: fmt.Sprintf("failed to decode pod: %v", err)},
+		}
+	}
+
+	policy, err := ac.loadPolicy()
+	if err != nil {
+		// Fail closed: a transient or malformed policy ConfigMap must not
+		// silently disable every configured rule. Rejecting is visible and
+		// recoverable; allowing everything through is neither.
+		logger.Errorw("failed to load pod policy, rejecting pod", zap.Error(err))
+		return &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result:  &metav1.Status{Message: fmt.Sprintf("pod policy unavailable, rejecting: %v", err)},
+		}
+	}
+
+	if violations := evaluate(policy, &pod); len(violations) > 0 {
+		logger.Infow("rejecting pod", "pod", pod.Name, "namespace", pod.Namespace, "violations", violations)
+		return &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("pod %s/%s violates policy: %v", pod.Namespace, pod.Name, violations),
+			},
+		}
+	}
+
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
+
+// Path implements AdmissionController.
+func (ac *reconciler) Path() string {
+	return ac.path
+}
+
+func (ac *reconciler) loadPolicy() (*PodPolicy, error) {
+	cm, err := ac.cmlister.ConfigMaps(system.Namespace()).Get(ConfigMapName)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching policy configmap: %w", err)
+	}
+	return parsePodPolicy(cm.Data)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2023 The Tekton Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validatingwebhook
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"knative.dev/pkg/system"
+)
+
+func newCMLister(t *testing.T, cms ...*corev1.ConfigMap) corelisters.ConfigMapLister {
+	t.Helper()
+	indexer := cache.NewIndexer(cache.DeletionHandlingMetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, cm := range cms {
+		if err := indexer.Add(cm); err != nil {
+			t.Fatalf("adding configmap to indexer: %v", err)
+		}
+	}
+	return corelisters.NewConfigMapLister(indexer)
+}
+
+func admitRequest(t *testing.T, pod *corev1.Pod) *admissionv1.AdmissionRequest {
+	t.Helper()
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("marshalling pod: %v", err)
+	}
+	return &admissionv1.AdmissionRequest{Object: runtime.RawExtension{Raw: raw}}
+}
+
+func TestAdmit_FailsClosedWhenPolicyConfigMapMissing(t *testing.T) {
+	t.Setenv("SYSTEM_NAMESPACE", "knative-testing")
+
+	ac := &reconciler{cmlister: newCMLister(t)}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "some-pod", Namespace: "default"}}
+
+	resp := ac.Admit(context.Background(), admitRequest(t, pod))
+
+	if resp.Allowed {
+		t.Error("Admit() allowed the pod when the policy ConfigMap couldn't be loaded; want it to fail closed")
+	}
+}
+
+func TestAdmit_FailsClosedWhenPolicyConfigMapMalformed(t *testing.T) {
+	t.Setenv("SYSTEM_NAMESPACE", "knative-testing")
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: ConfigMapName, Namespace: system.Namespace()},
+		Data:       map[string]string{policyConfigMapKey: "not: [valid, yaml: policy"},
+	}
+	ac := &reconciler{cmlister: newCMLister(t, cm)}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "some-pod", Namespace: "default"}}
+
+	resp := ac.Admit(context.Background(), admitRequest(t, pod))
+
+	if resp.Allowed {
+		t.Error("Admit() allowed the pod when the policy ConfigMap was malformed; want it to fail closed")
+	}
+}
+
+func TestAdmit_AllowsPodSatisfyingPolicy(t *testing.T) {
+	t.Setenv("SYSTEM_NAMESPACE", "knative-testing")
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: ConfigMapName, Namespace: system.Namespace()},
+		Data:       map[string]string{policyConfigMapKey: "requiredLabels: [\"team\"]"},
+	}
+	ac := &reconciler{cmlister: newCMLister(t, cm)}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:      "some-pod",
+		Namespace: "default",
+		Labels:    map[string]string{"team": "pipelines"},
+	}}
+
+	resp := ac.Admit(context.Background(), admitRequest(t, pod))
+
+	if !resp.Allowed {
+		t.Errorf("Admit() rejected a pod that satisfies policy: %v", resp.Result)
+	}
+}